@@ -1,21 +1,532 @@
 package vcd
 
 import (
+	"bytes"
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
+	"github.com/docker/machine/libmachine/log"
 	"github.com/docker/machine/libmachine/mcnutils"
 	"github.com/docker/machine/libmachine/ssh"
 	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
 )
 
+// networkSpec is the parsed form of a --vcd-network flag value:
+// "name[:mode[:ip[:primary]]]", e.g. "OrgNet1:POOL", "OrgNet2:MANUAL:192.168.1.50:true".
+type networkSpec struct {
+	Name      string
+	Mode      string
+	IPAddress string
+	Primary   bool
+}
+
+// parseNetworkSpec parses a single --vcd-network flag value. Mode defaults
+// to POOL when omitted; only the first --vcd-network is primary by default.
+func parseNetworkSpec(raw string) (networkSpec, error) {
+	parts := strings.Split(raw, ":")
+	if len(parts) == 0 || parts[0] == "" {
+		return networkSpec{}, fmt.Errorf("invalid --vcd-network value %q: network name is required", raw)
+	}
+
+	spec := networkSpec{
+		Name: parts[0],
+		Mode: types.IPAllocationModePool,
+	}
+	if len(parts) > 1 && parts[1] != "" {
+		spec.Mode = strings.ToUpper(parts[1])
+	}
+	switch spec.Mode {
+	case types.IPAllocationModePool, types.IPAllocationModeDHCP, types.IPAllocationModeManual, types.IPAllocationModeNone:
+	default:
+		return networkSpec{}, fmt.Errorf("invalid --vcd-network value %q: unknown allocation mode %q", raw, spec.Mode)
+	}
+	if len(parts) > 2 {
+		spec.IPAddress = parts[2]
+	}
+	if spec.Mode == types.IPAllocationModeManual && spec.IPAddress == "" {
+		return networkSpec{}, fmt.Errorf("invalid --vcd-network value %q: MANUAL mode requires an IP address", raw)
+	}
+	if len(parts) > 3 {
+		primary, err := strconv.ParseBool(parts[3])
+		if err != nil {
+			return networkSpec{}, fmt.Errorf("invalid --vcd-network value %q: %s", raw, err)
+		}
+		spec.Primary = primary
+	}
+	return spec, nil
+}
+
+// networkSpecs resolves the driver's network configuration: the repeatable
+// --vcd-network flags if any were given, or a single POOL-allocated NIC on
+// the legacy --vcd-orgvdcnetwork otherwise. If no entry is marked primary,
+// the first one is; entries that were marked primary are all kept so.
+func (d *Driver) networkSpecs() ([]networkSpec, error) {
+	if len(d.Networks) == 0 {
+		return []networkSpec{{
+			Name:    d.VcdOrgVDCNetwork,
+			Mode:    types.IPAllocationModePool,
+			Primary: true,
+		}}, nil
+	}
+
+	specs := make([]networkSpec, 0, len(d.Networks))
+	primarySet := false
+	for _, raw := range d.Networks {
+		spec, err := parseNetworkSpec(raw)
+		if err != nil {
+			return nil, err
+		}
+		if spec.Primary {
+			primarySet = true
+		}
+		specs = append(specs, spec)
+	}
+	if !primarySet {
+		specs[0].Primary = true
+	}
+	return specs, nil
+}
+
+// dnatSpec is the parsed form of a --vcd-edge-dnat flag value:
+// "externalIP:externalPort:internalPort[:protocol]".
+type dnatSpec struct {
+	ExternalIP   string
+	ExternalPort string
+	InternalPort string
+	Protocol     string
+}
+
+func parseDNATSpec(raw string) (dnatSpec, error) {
+	parts := strings.Split(raw, ":")
+	if len(parts) < 3 {
+		return dnatSpec{}, fmt.Errorf("invalid --vcd-edge-dnat value %q: expected externalIP:externalPort:internalPort[:protocol]", raw)
+	}
+	spec := dnatSpec{
+		ExternalIP:   parts[0],
+		ExternalPort: parts[1],
+		InternalPort: parts[2],
+		Protocol:     "tcp",
+	}
+	if len(parts) > 3 && parts[3] != "" {
+		spec.Protocol = parts[3]
+	}
+	return spec, nil
+}
+
+// createEdgeGatewayDNATRules maps the docker-machine host's primary NIC
+// through --vcd-edgegateway using the rules given via --vcd-edge-dnat, so
+// the Docker daemon (and SSH) are reachable from outside the OrgVDC.
+func (d *Driver) createEdgeGatewayDNATRules(vdc *govcd.Vdc, vm *govcd.VM, primaryNetworkName string) error {
+	egw, err := vdc.GetEdgeGatewayByName(d.EdgeGateway, true)
+	if err != nil {
+		return fmt.Errorf("unable to find EdgeGateway %q: %s", d.EdgeGateway, err)
+	}
+
+	primaryNetwork, err := vdc.GetOrgVdcNetworkByName(primaryNetworkName, true)
+	if err != nil {
+		return fmt.Errorf("unable to find OrgVdc network %q: %s", primaryNetworkName, err)
+	}
+
+	if err = vm.Refresh(); err != nil {
+		return err
+	}
+	internalIP, err := d.getPrimaryInternalIP(vm)
+	if err != nil {
+		return err
+	}
+
+	for _, raw := range d.EdgeGatewayDNAT {
+		spec, err := parseDNATSpec(raw)
+		if err != nil {
+			return err
+		}
+		log.Infof("Creating DNAT rule %s:%s -> %s:%s on EdgeGateway %s...", spec.ExternalIP, spec.ExternalPort, internalIP, spec.InternalPort, d.EdgeGateway)
+		_, err = egw.AddDNATRule(govcd.NatRule{
+			NetworkHref:  primaryNetwork.OrgVDCNetwork.HREF,
+			ExternalIP:   spec.ExternalIP,
+			ExternalPort: spec.ExternalPort,
+			InternalIP:   internalIP,
+			InternalPort: spec.InternalPort,
+			Protocol:     spec.Protocol,
+			Description:  fmt.Sprintf("docker-machine %s", d.MachineName),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to create DNAT rule on EdgeGateway %q: %s", d.EdgeGateway, err)
+		}
+		d.mapEdgeGatewayDNATPort(spec)
+	}
+	return nil
+}
+
+// mapEdgeGatewayDNATPort records spec's external endpoint on the driver so
+// GetIP/GetURL (and WaitForSSH, via the inherited GetSSHPort) reach the
+// guest through the EdgeGateway instead of its internal OrgVDC address: the
+// external IP is always recorded, and --vcd-ssh-port/--vcd-docker-port are
+// rewritten to the matching external port whenever spec maps that port.
+func (d *Driver) mapEdgeGatewayDNATPort(spec dnatSpec) {
+	d.EdgeGatewayExternalIP = spec.ExternalIP
+
+	externalPort, err := strconv.Atoi(spec.ExternalPort)
+	if err != nil {
+		return
+	}
+	switch spec.InternalPort {
+	case strconv.Itoa(d.SSHPort):
+		d.SSHPort = externalPort
+	case strconv.Itoa(d.DockerPort):
+		d.DockerPort = externalPort
+	}
+}
+
+// getPrimaryInternalIP returns the internal IP address vCD allocated to the
+// VM's primary NIC.
+func (d *Driver) getPrimaryInternalIP(vm *govcd.VM) (string, error) {
+	if vm.VM.NetworkConnectionSection == nil {
+		return "", fmt.Errorf("VM %s has no network connections", vm.VM.Name)
+	}
+	primaryIndex := vm.VM.NetworkConnectionSection.PrimaryNetworkConnectionIndex
+	for _, n := range vm.VM.NetworkConnectionSection.NetworkConnection {
+		if n.NetworkConnectionIndex == primaryIndex && n.IPAddress != "" {
+			return n.IPAddress, nil
+		}
+	}
+	return "", fmt.Errorf("could not find an internal IP for the primary NIC of %s", vm.VM.Name)
+}
+
+// waitForTCP polls address until a TCP connection succeeds or the retry
+// budget is exhausted. Used after PowerOn to make sure the guest
+// customization reboot has actually happened before docker-machine's
+// provisioner starts racing it over SSH.
+func waitForTCP(address string) error {
+	return mcnutils.WaitForSpecificOrError(func() (bool, error) {
+		conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+		if err != nil {
+			return false, nil
+		}
+		_ = conn.Close()
+		return true, nil
+	}, 60, 5*time.Second)
+}
+
+// extraDiskSpec is the parsed form of a --vcd-extra-disk flag value:
+// "name:sizeGB[:storageProfile[:busType]]".
+type extraDiskSpec struct {
+	Name           string
+	SizeGb         int
+	StorageProfile string
+	BusType        string
+	BusSubType     string
+}
+
+// defaultDiskBusType is vCD's numeric code for a SCSI bus, the same bus
+// type templates normally use for their root disk.
+const defaultDiskBusType = "6"
+
+// busSubTypeForBusType maps every --vcd-extra-disk busType code vCD accepts
+// to the BusSubType it requires; vCD rejects a disk spec where the two
+// disagree. Keys are vCD's numeric bus type codes.
+var busSubTypeForBusType = map[string]string{
+	"5":  "",                 // IDE: no sub-type
+	"6":  "VirtualSCSI",      // SCSI, matching the template's own root disk
+	"20": "vmware.sata.ahci", // SATA
+}
+
+// parseExtraDiskSpec parses a single --vcd-extra-disk flag value. BusType
+// defaults to SCSI, matching the bus of the template's own root disk.
+func parseExtraDiskSpec(raw string) (extraDiskSpec, error) {
+	parts := strings.Split(raw, ":")
+	if len(parts) < 2 || parts[0] == "" {
+		return extraDiskSpec{}, fmt.Errorf("invalid --vcd-extra-disk value %q: expected name:sizeGB[:storageProfile[:busType]]", raw)
+	}
+	sizeGb, err := strconv.Atoi(parts[1])
+	if err != nil || sizeGb < 1 {
+		return extraDiskSpec{}, fmt.Errorf("invalid --vcd-extra-disk value %q: sizeGB must be a positive integer", raw)
+	}
+	spec := extraDiskSpec{
+		Name:   parts[0],
+		SizeGb: sizeGb,
+	}
+	if len(parts) > 2 && parts[2] != "" {
+		spec.StorageProfile = parts[2]
+	}
+	spec.BusType = defaultDiskBusType
+	if len(parts) > 3 && parts[3] != "" {
+		spec.BusType = strings.ToUpper(parts[3])
+	}
+	busSubType, ok := busSubTypeForBusType[spec.BusType]
+	if !ok {
+		return extraDiskSpec{}, fmt.Errorf("invalid --vcd-extra-disk value %q: unsupported busType %q", raw, spec.BusType)
+	}
+	spec.BusSubType = busSubType
+	return spec, nil
+}
+
+// createExtraDisks creates and attaches one independent disk per
+// --vcd-extra-disk flag, returning their HREFs so Remove can detach and
+// delete them before the vApp is torn down.
+func (d *Driver) createExtraDisks(vdc *govcd.Vdc, vm *govcd.VM) ([]string, error) {
+	hrefs := make([]string, 0, len(d.ExtraDisks))
+	for _, raw := range d.ExtraDisks {
+		spec, err := parseExtraDiskSpec(raw)
+		if err != nil {
+			return hrefs, err
+		}
+
+		disk := &types.Disk{
+			Name:       spec.Name,
+			SizeMb:     int64(spec.SizeGb) * 1024,
+			BusType:    spec.BusType,
+			BusSubType: spec.BusSubType,
+		}
+		if spec.StorageProfile != "" {
+			storageProfile, err := vdc.FindStorageProfileReference(spec.StorageProfile)
+			if err != nil {
+				return hrefs, fmt.Errorf("unable to find storage profile %q for disk %q: %s", spec.StorageProfile, spec.Name, err)
+			}
+			disk.StorageProfile = &types.Reference{HREF: storageProfile.HREF}
+		}
+
+		log.Infof("Creating independent disk %s (%d GB)...", spec.Name, spec.SizeGb)
+		task, err := vdc.CreateDisk(&types.DiskCreateParams{Disk: disk})
+		if err != nil {
+			return hrefs, fmt.Errorf("unable to create disk %q: %s", spec.Name, err)
+		}
+		if err = task.WaitTaskCompletion(); err != nil {
+			return hrefs, fmt.Errorf("error creating disk %q: %s", spec.Name, err)
+		}
+
+		diskHREF := task.Task.Owner.HREF
+		createdDisk, err := vdc.GetDiskByHref(diskHREF)
+		if err != nil {
+			return hrefs, fmt.Errorf("unable to look up newly created disk %q: %s", spec.Name, err)
+		}
+		hrefs = append(hrefs, diskHREF)
+
+		log.Infof("Attaching disk %s to %s...", spec.Name, vm.VM.Name)
+		attachTask, err := vm.AttachDisk(&types.DiskAttachOrDetachParams{
+			Disk: &types.Reference{HREF: createdDisk.Disk.HREF},
+		})
+		if err != nil {
+			return hrefs, fmt.Errorf("unable to attach disk %q: %s", spec.Name, err)
+		}
+		if err = attachTask.WaitTaskCompletion(); err != nil {
+			return hrefs, fmt.Errorf("error attaching disk %q: %s", spec.Name, err)
+		}
+	}
+	return hrefs, nil
+}
+
+// detachAndDeleteDisks detaches and deletes every independent disk tracked
+// in diskHREFs. Errors are logged rather than returned so that a failure on
+// one disk doesn't stop the others, or the vApp teardown that follows, from
+// being attempted.
+func (d *Driver) detachAndDeleteDisks(vdc *govcd.Vdc, vm *govcd.VM) {
+	for _, href := range d.DiskHREFs {
+		disk, err := vdc.GetDiskByHref(href)
+		if err != nil {
+			log.Warnf("Could not find disk %s to delete it: %s", href, err)
+			continue
+		}
+
+		if vm != nil {
+			log.Infof("Detaching disk %s...", disk.Disk.Name)
+			detachTask, err := vm.DetachDisk(&types.DiskAttachOrDetachParams{
+				Disk: &types.Reference{HREF: disk.Disk.HREF},
+			})
+			if err != nil {
+				log.Warnf("Could not detach disk %s: %s", disk.Disk.Name, err)
+			} else if err = detachTask.WaitTaskCompletion(); err != nil {
+				log.Warnf("Error detaching disk %s: %s", disk.Disk.Name, err)
+			}
+		}
+
+		log.Infof("Deleting disk %s...", disk.Disk.Name)
+		deleteTask, err := disk.Delete()
+		if err != nil {
+			log.Warnf("Could not delete disk %s: %s", disk.Disk.Name, err)
+			continue
+		}
+		if err = deleteTask.WaitTaskCompletion(); err != nil {
+			log.Warnf("Error deleting disk %s: %s", disk.Disk.Name, err)
+		}
+	}
+}
+
+// applyVMSizing sets vm's CPU, memory and (if --vcd-disk-size-gb was given)
+// root disk size to the driver's configured values and pushes the update to
+// vCD. Cluster members composed via --vcd-vm-count share the docker-machine
+// host's sizing; there is no separate per-role sizing flag.
+func (d *Driver) applyVMSizing(vm *govcd.VM) (*govcd.VM, error) {
+	if vm.VM.VmSpecSection == nil {
+		return vm, fmt.Errorf("VM Spec Section empty")
+	}
+	vm.Refresh()
+
+	vm.VM.VmSpecSection.MemoryResourceMb.Configured = int64(d.MemorySizeMb)
+	vm.VM.VmSpecSection.NumCpus = &d.NumCpus
+	vm.VM.VmSpecSection.NumCoresPerSocket = &d.CoresPerSocket
+
+	if d.DiskSizeGb > 0 {
+		diskSection := vm.VM.VmSpecSection.DiskSection
+		if diskSection == nil || len(diskSection.DiskSettings) < 1 {
+			return vm, fmt.Errorf("VM %s has no root disk to resize", vm.VM.Name)
+		}
+		log.Infof("Resizing root disk of %s to %d GB...", vm.VM.Name, d.DiskSizeGb)
+		diskSection.DiskSettings[0].SizeMb = int64(d.DiskSizeGb) * 1024
+	}
+
+	log.Infof("Updating virtual hardware specs for %s...", vm.VM.Name)
+	return vm.UpdateVmSpecSection(vm.VM.VmSpecSection, d.Description)
+}
+
+// resolveComputePolicyByName looks up a single VDC compute policy (sizing or
+// placement; vCD models both the same way) by exact name.
+func resolveComputePolicyByName(client *govcd.VCDClient, name string) (*govcd.VdcComputePolicy, error) {
+	queryParams := url.Values{}
+	queryParams.Add("filter", fmt.Sprintf("name==%s", name))
+	policies, err := client.Client.GetAllVdcComputePolicies(queryParams)
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up compute policy %q: %s", name, err)
+	}
+	if len(policies) == 0 {
+		return nil, fmt.Errorf("no compute policy named %q found", name)
+	}
+	if len(policies) > 1 {
+		return nil, fmt.Errorf("more than one compute policy named %q found", name)
+	}
+	return policies[0], nil
+}
+
+// applyComputePolicies assigns the --vcd-sizing-policy and
+// --vcd-placement-policy/--vcd-host-group policies to vm, if any were given.
+// --vcd-host-group is an alternative spelling of --vcd-placement-policy: in
+// vCD, host groups are surfaced to tenants as placement policies backed by
+// an NSX-T host group, so both resolve the same way.
+func (d *Driver) applyComputePolicies(client *govcd.VCDClient, vm *govcd.VM) (*govcd.VM, error) {
+	if d.PlacementPolicy != "" && d.HostGroup != "" {
+		return vm, fmt.Errorf("only one of --vcd-placement-policy or --vcd-host-group may be set")
+	}
+
+	if d.SizingPolicy != "" {
+		policy, err := resolveComputePolicyByName(client, d.SizingPolicy)
+		if err != nil {
+			return vm, err
+		}
+		log.Infof("Assigning sizing policy %s to %s...", d.SizingPolicy, vm.VM.Name)
+		vm, err = vm.UpdateComputePolicy(policy.VdcComputePolicy)
+		if err != nil {
+			return vm, fmt.Errorf("unable to assign sizing policy %q: %s", d.SizingPolicy, err)
+		}
+	}
+
+	placementPolicyName := d.PlacementPolicy
+	if placementPolicyName == "" {
+		placementPolicyName = d.HostGroup
+	}
+	if placementPolicyName != "" {
+		policy, err := resolveComputePolicyByName(client, placementPolicyName)
+		if err != nil {
+			return vm, err
+		}
+		log.Infof("Assigning placement policy %s to %s...", placementPolicyName, vm.VM.Name)
+		if err = updateVMPlacementPolicy(client, vm, policy); err != nil {
+			return vm, fmt.Errorf("unable to assign placement policy %q: %s", placementPolicyName, err)
+		}
+	}
+
+	return vm, nil
+}
+
+// updateVMPlacementPolicy assigns a VM placement policy to vm. The installed
+// go-vcloud-director release's UpdateComputePolicy only wires VmSizingPolicy
+// through to vCD's reconfigureVm action, so placement policies are applied
+// by driving that same action directly.
+func updateVMPlacementPolicy(client *govcd.VCDClient, vm *govcd.VM, policy *govcd.VdcComputePolicy) error {
+	policyHREF, err := client.Client.OpenApiBuildEndpoint(types.OpenApiPathVersion1_0_0, types.OpenApiEndpointVdcComputePolicies, policy.VdcComputePolicy.ID)
+	if err != nil {
+		return fmt.Errorf("error constructing HREF for placement policy %q: %s", policy.VdcComputePolicy.Name, err)
+	}
+
+	task, err := client.Client.ExecuteTaskRequest(vm.VM.HREF+"/action/reconfigureVm", http.MethodPost,
+		types.MimeVM, "error updating VM placement policy: %s", &types.Vm{
+			Xmlns:         types.XMLNamespaceVCloud,
+			Ovf:           types.XMLNamespaceOVF,
+			Name:          vm.VM.Name,
+			Description:   vm.VM.Description,
+			ComputePolicy: &types.ComputePolicy{VmPlacementPolicy: &types.Reference{HREF: policyHREF.String()}},
+		})
+	if err != nil {
+		return err
+	}
+	if err = task.WaitTaskCompletion(); err != nil {
+		return err
+	}
+	return vm.Refresh()
+}
+
+// createVmAffinityGroups creates one mandatory VM anti-affinity rule per
+// --vcd-vm-affinity-group name, spanning every VM in the vApp, so that
+// cluster nodes land on different hosts. The created rules' HREFs are
+// tracked on the Driver so Remove can delete them; they are VDC-scoped
+// objects that otherwise outlive the vApp.
+func (d *Driver) createVmAffinityGroups(vdc *govcd.Vdc) error {
+	if len(d.VMHREFs) < 2 {
+		return fmt.Errorf("--vcd-vm-affinity-group requires at least 2 VMs; set --vcd-vm-count accordingly")
+	}
+
+	vmRefs := make([]*types.Reference, len(d.VMHREFs))
+	for i, href := range d.VMHREFs {
+		vmRefs[i] = &types.Reference{HREF: href}
+	}
+
+	isEnabled := true
+	isMandatory := true
+	for _, name := range d.VmAffinityGroups {
+		log.Infof("Creating VM anti-affinity rule %s...", name)
+		rule, err := vdc.CreateVmAffinityRule(&types.VmAffinityRule{
+			Name:         name,
+			IsEnabled:    &isEnabled,
+			IsMandatory:  &isMandatory,
+			Polarity:     types.PolarityAntiAffinity,
+			VmReferences: []*types.VMs{{VMReference: vmRefs}},
+		})
+		if err != nil {
+			return fmt.Errorf("unable to create VM anti-affinity rule %q: %s", name, err)
+		}
+		d.VmAffinityGroupHREFs = append(d.VmAffinityGroupHREFs, rule.VmAffinityRule.HREF)
+	}
+	return nil
+}
+
+// deleteVmAffinityGroups deletes every VM anti-affinity rule tracked in
+// VmAffinityGroupHREFs. Errors are logged rather than returned so that a
+// failure on one rule doesn't stop the others, or the vApp teardown that
+// follows, from being attempted.
+func (d *Driver) deleteVmAffinityGroups(vdc *govcd.Vdc) {
+	for _, href := range d.VmAffinityGroupHREFs {
+		rule, err := vdc.GetVmAffinityRuleByHref(href)
+		if err != nil {
+			log.Warnf("Could not find VM affinity rule %s to delete it: %s", href, err)
+			continue
+		}
+		log.Infof("Deleting VM affinity rule %s...", rule.VmAffinityRule.Name)
+		if err = rule.Delete(); err != nil {
+			log.Warnf("Could not delete VM affinity rule %s: %s", rule.VmAffinityRule.Name, err)
+		}
+	}
+}
+
 func (d *Driver) vcdSeemsAlive() bool {
-	client, err := newClient(*d.VcdURL, d.VcdUser, d.VcdPassword, d.VcdOrg, d.VcdInsecure)
+	client, err := d.newClient()
 	if err != nil {
 		return false
 	}
@@ -53,25 +564,146 @@ func (d *Driver) publicSSHKeyPath() string {
 	return d.GetSSHKeyPath() + ".pub"
 }
 
-func (d *Driver) getGuestCustomizationScript() (string, error) {
-	key, err := d.createSSHKey()
-	if err != nil {
-		return "", err
-	}
-	sshCustomScript := `#!/bin/bash
+// defaultCustomizationTemplate is used when the user does not supply
+// --vcd-user-data/--vcd-user-data-file: it just drops the generated SSH
+// public key into the configured SSH user's authorized_keys.
+const defaultCustomizationTemplate = `#!/bin/bash
 if [ x$1 == x"precustomization" ]; then
 	echo 'Precustom'
 elif [ x$1 == x"postcustomization" ]; then
-	mkdir -p /root/.ssh
-	echo '%s' >> /root/.ssh/authorized_keys
-	chmod -R go-rwx /root/.ssh
+	mkdir -p {{.SSHUserHome}}/.ssh
+	echo '{{.SSHPublicKey}}' >> {{.SSHUserHome}}/.ssh/authorized_keys
+	chown -R {{.SSHUser}} {{.SSHUserHome}}/.ssh
+	chmod -R go-rwx {{.SSHUserHome}}/.ssh
 fi`
-	sshCustomScript = fmt.Sprintf(sshCustomScript, strings.TrimSpace(key))
-	return sshCustomScript, nil
+
+// cloudInitCustomizationTemplate seeds the NoCloud datasource with the
+// user-supplied cloud-init YAML so images that ship cloud-init (Ubuntu,
+// RHEL, Photon, ...) pick it up on first boot.
+const cloudInitCustomizationTemplate = `#!/bin/bash
+if [ x$1 == x"precustomization" ]; then
+	mkdir -p /var/lib/cloud/seed/nocloud
+	cat > /var/lib/cloud/seed/nocloud/meta-data <<'EOF'
+instance-id: {{.MachineName}}
+local-hostname: {{.Hostname}}
+EOF
+	cat > /var/lib/cloud/seed/nocloud/user-data <<'EOF'
+{{.UserData}}
+EOF
+elif [ x$1 == x"postcustomization" ]; then
+	echo 'Postcustom'
+fi`
+
+// customizationVars are the variables available to templated
+// --vcd-user-data(-file) content and to the built-in templates above.
+type customizationVars struct {
+	MachineName  string
+	Hostname     string
+	IPAddress    string
+	SSHUser      string
+	SSHUserHome  string
+	SSHPublicKey string
+	UserData     string
+}
+
+func sshUserHome(user string) string {
+	if user == "root" {
+		return "/root"
+	}
+	return fmt.Sprintf("/home/%s", user)
+}
+
+// getGuestCustomizationScript renders the GuestCustomizationSection script
+// that vCD runs inside the guest on first boot. By default it just injects
+// the generated SSH key, but users can override it entirely with
+// --vcd-user-data/--vcd-user-data-file, optionally as cloud-init YAML via
+// --vcd-cloud-init. ipAddress is the static IP requested for the primary
+// network, if any (MANUAL allocation mode), and is empty for POOL/DHCP.
+func (d *Driver) getGuestCustomizationScript(ipAddress string) (string, error) {
+	key, err := d.createSSHKey()
+	if err != nil {
+		return "", err
+	}
+
+	sshUser := d.SSHUser
+	if sshUser == "" {
+		sshUser = defaultSSHUser
+	}
+
+	vars := customizationVars{
+		MachineName:  d.MachineName,
+		Hostname:     d.MachineName,
+		IPAddress:    ipAddress,
+		SSHUser:      sshUser,
+		SSHUserHome:  sshUserHome(sshUser),
+		SSHPublicKey: strings.TrimSpace(key),
+	}
+
+	userData, err := d.resolveUserData()
+	if err != nil {
+		return "", err
+	}
+
+	tmplText := defaultCustomizationTemplate
+	switch {
+	case d.CloudInit && userData != "":
+		userTmpl, err := template.New("user-data").Parse(userData)
+		if err != nil {
+			return "", fmt.Errorf("unable to parse user data template: %s", err)
+		}
+		var renderedUserData bytes.Buffer
+		if err = userTmpl.Execute(&renderedUserData, vars); err != nil {
+			return "", fmt.Errorf("unable to render user data template: %s", err)
+		}
+		vars.UserData = renderedUserData.String()
+		tmplText = cloudInitCustomizationTemplate
+	case userData != "":
+		tmplText = userData
+	}
+
+	tmpl, err := template.New("guest-customization").Parse(tmplText)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse guest customization template: %s", err)
+	}
+
+	var rendered bytes.Buffer
+	if err = tmpl.Execute(&rendered, vars); err != nil {
+		return "", fmt.Errorf("unable to render guest customization template: %s", err)
+	}
+
+	return rendered.String(), nil
+}
+
+// resolveUserData returns the raw --vcd-user-data content, preferring the
+// inline flag over the file if both are set, or "" if neither was given.
+func (d *Driver) resolveUserData() (string, error) {
+	if d.UserData != "" {
+		return d.UserData, nil
+	}
+	if d.UserDataFile != "" {
+		content, err := ioutil.ReadFile(d.UserDataFile)
+		if err != nil {
+			return "", fmt.Errorf("unable to read %s: %s", d.UserDataFile, err)
+		}
+		return string(content), nil
+	}
+	return "", nil
+}
+
+func (d *Driver) getVdc() (*govcd.Vdc, error) {
+	client, err := d.newClient()
+	if err != nil {
+		return nil, err
+	}
+	org, err := client.GetOrgByName(d.VcdOrg)
+	if err != nil {
+		return nil, err
+	}
+	return org.GetVDCByName(d.VcdVdc, false)
 }
 
 func (d *Driver) getVApp() (*govcd.VApp, error) {
-	client, err := newClient(*d.VcdURL, d.VcdUser, d.VcdPassword, d.VcdOrg, d.VcdInsecure)
+	client, err := d.newClient()
 	if err != nil {
 		return nil, err
 	}
@@ -103,7 +735,7 @@ func (d *Driver) getVApp() (*govcd.VApp, error) {
 }
 
 func (d *Driver) getVM() (*govcd.VM, error) {
-	client, err := newClient(*d.VcdURL, d.VcdUser, d.VcdPassword, d.VcdOrg, d.VcdInsecure)
+	client, err := d.newClient()
 	if err != nil {
 		return nil, err
 	}
@@ -122,11 +754,19 @@ func (d *Driver) getVM() (*govcd.VM, error) {
 		return nil, err
 	}
 
-	if len(vapp.VApp.Children.VM) != 1 {
+	if len(vapp.VApp.Children.VM) < 1 {
 		return nil, fmt.Errorf("VM count != 1")
 	}
+
+	// When the vApp holds several VMs (see --vcd-vm-count), the docker-machine
+	// host is always the first one that was composed.
+	href := vapp.VApp.Children.VM[0].HREF
+	if len(d.VMHREFs) > 0 {
+		href = d.VMHREFs[0]
+	}
+
 	vm := govcd.NewVM(&client.Client)
-	vm.VM.HREF = vapp.VApp.Children.VM[0].HREF
+	vm.VM.HREF = href
 	err = vm.Refresh()
 	if err != nil {
 		return nil, err
@@ -137,10 +777,39 @@ func (d *Driver) getVM() (*govcd.VM, error) {
 
 }
 
-func newClient(apiURL url.URL, user, password, org string, insecure bool) (*govcd.VCDClient, error) {
+// resolveAuthToken returns the auth header/token pair to use for token-based
+// authentication, in order of precedence: --vcd-api-token, --vcd-bearer-token,
+// then the generic --vcd-token (treated as an API token, the common case for
+// CI systems talking to VCF/Cloud Director 10.4+). Returns "", "" when none
+// were supplied, meaning basic auth should be used instead.
+func (d *Driver) resolveAuthToken() (header, token string) {
+	switch {
+	case d.VcdAPIToken != "":
+		return govcd.ApiTokenHeader, d.VcdAPIToken
+	case d.VcdBearerToken != "":
+		return govcd.BearerTokenHeader, d.VcdBearerToken
+	case d.VcdToken != "":
+		return govcd.ApiTokenHeader, d.VcdToken
+	default:
+		return "", ""
+	}
+}
+
+// newClient builds an authenticated vCD client using the driver's
+// configured API version and credentials, preferring token-based auth over
+// user/password when a token was supplied.
+func (d *Driver) newClient() (*govcd.VCDClient, error) {
+	tokenHeader, token := d.resolveAuthToken()
+	return newClient(*d.VcdURL, d.VcdUser, d.VcdPassword, d.VcdOrg, d.VcdInsecure, d.VcdAPIVersion, tokenHeader, token)
+}
+
+func newClient(apiURL url.URL, user, password, org string, insecure bool, apiVersion string, tokenHeader, token string) (*govcd.VCDClient, error) {
+	if apiVersion == "" {
+		apiVersion = defaultAPIVersion
+	}
 	vcdclient := &govcd.VCDClient{
 		Client: govcd.Client{
-			APIVersion: "36.3",
+			APIVersion: apiVersion,
 			VCDHREF:    apiURL,
 			Http: http.Client{
 				Transport: &http.Transport{
@@ -155,6 +824,14 @@ func newClient(apiURL url.URL, user, password, org string, insecure bool) (*govc
 			MaxRetryTimeout: 60, // Default timeout in seconds for retries calls in functions
 		},
 	}
+
+	if token != "" {
+		if err := vcdclient.SetToken(org, tokenHeader, token); err != nil {
+			return nil, fmt.Errorf("unable to authenticate to Org \"%s\" using a token: %s", org, err)
+		}
+		return vcdclient, nil
+	}
+
 	err := vcdclient.Authenticate(user, password, org)
 	if err != nil {
 		return nil, fmt.Errorf("unable to authenticate to Org \"%s\": %s", org, err)
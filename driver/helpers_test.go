@@ -0,0 +1,191 @@
+package vcd
+
+import (
+	"testing"
+
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+func TestParseNetworkSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    networkSpec
+		wantErr bool
+	}{
+		{
+			name: "name only defaults to POOL",
+			raw:  "OrgNet1",
+			want: networkSpec{Name: "OrgNet1", Mode: types.IPAllocationModePool},
+		},
+		{
+			name: "explicit mode is upcased",
+			raw:  "OrgNet1:dhcp",
+			want: networkSpec{Name: "OrgNet1", Mode: types.IPAllocationModeDHCP},
+		},
+		{
+			name: "manual mode with IP",
+			raw:  "OrgNet2:MANUAL:192.168.1.50",
+			want: networkSpec{Name: "OrgNet2", Mode: types.IPAllocationModeManual, IPAddress: "192.168.1.50"},
+		},
+		{
+			name: "manual mode with IP and primary",
+			raw:  "OrgNet2:MANUAL:192.168.1.50:true",
+			want: networkSpec{Name: "OrgNet2", Mode: types.IPAllocationModeManual, IPAddress: "192.168.1.50", Primary: true},
+		},
+		{
+			name:    "empty name is rejected",
+			raw:     "",
+			wantErr: true,
+		},
+		{
+			name:    "unknown mode is rejected",
+			raw:     "OrgNet1:BOGUS",
+			wantErr: true,
+		},
+		{
+			name:    "manual mode without IP is rejected",
+			raw:     "OrgNet1:MANUAL",
+			wantErr: true,
+		},
+		{
+			name:    "non-boolean primary is rejected",
+			raw:     "OrgNet1:POOL::nope",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNetworkSpec(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseNetworkSpec(%q): expected error, got %+v", tt.raw, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseNetworkSpec(%q): unexpected error: %s", tt.raw, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseNetworkSpec(%q) = %+v, want %+v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDNATSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    dnatSpec
+		wantErr bool
+	}{
+		{
+			name: "defaults protocol to tcp",
+			raw:  "1.2.3.4:2376:2376",
+			want: dnatSpec{ExternalIP: "1.2.3.4", ExternalPort: "2376", InternalPort: "2376", Protocol: "tcp"},
+		},
+		{
+			name: "explicit protocol",
+			raw:  "1.2.3.4:2222:22:udp",
+			want: dnatSpec{ExternalIP: "1.2.3.4", ExternalPort: "2222", InternalPort: "22", Protocol: "udp"},
+		},
+		{
+			name:    "missing internalPort is rejected",
+			raw:     "1.2.3.4:2376",
+			wantErr: true,
+		},
+		{
+			name:    "empty value is rejected",
+			raw:     "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDNATSpec(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseDNATSpec(%q): expected error, got %+v", tt.raw, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDNATSpec(%q): unexpected error: %s", tt.raw, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseDNATSpec(%q) = %+v, want %+v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseExtraDiskSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    extraDiskSpec
+		wantErr bool
+	}{
+		{
+			name: "defaults to SCSI",
+			raw:  "data:10",
+			want: extraDiskSpec{Name: "data", SizeGb: 10, BusType: "6", BusSubType: "VirtualSCSI"},
+		},
+		{
+			name: "storage profile",
+			raw:  "data:10:gold",
+			want: extraDiskSpec{Name: "data", SizeGb: 10, StorageProfile: "gold", BusType: "6", BusSubType: "VirtualSCSI"},
+		},
+		{
+			name: "IDE bus type has no sub-type",
+			raw:  "data:10:gold:5",
+			want: extraDiskSpec{Name: "data", SizeGb: 10, StorageProfile: "gold", BusType: "5", BusSubType: ""},
+		},
+		{
+			name: "SATA bus type",
+			raw:  "data:10::20",
+			want: extraDiskSpec{Name: "data", SizeGb: 10, BusType: "20", BusSubType: "vmware.sata.ahci"},
+		},
+		{
+			name:    "missing name is rejected",
+			raw:     ":10",
+			wantErr: true,
+		},
+		{
+			name:    "non-numeric size is rejected",
+			raw:     "data:ten",
+			wantErr: true,
+		},
+		{
+			name:    "zero size is rejected",
+			raw:     "data:0",
+			wantErr: true,
+		},
+		{
+			name:    "unsupported bus type is rejected",
+			raw:     "data:10::SCSI",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseExtraDiskSpec(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseExtraDiskSpec(%q): expected error, got %+v", tt.raw, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseExtraDiskSpec(%q): unexpected error: %s", tt.raw, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseExtraDiskSpec(%q) = %+v, want %+v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
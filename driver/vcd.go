@@ -2,6 +2,7 @@ package vcd
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/url"
 	"strconv"
@@ -23,6 +24,10 @@ type Driver struct {
 	VcdInsecure      bool
 	VcdUser          string
 	VcdPassword      string
+	VcdAPIVersion    string
+	VcdToken         string // generic token, treated as an API token
+	VcdAPIToken      string // long-lived API token, exchanged for a bearer token on first use
+	VcdBearerToken   string // already-a-bearer session token
 	VcdOrgVDCNetwork string
 	Catalog          string
 	Template         string
@@ -36,6 +41,38 @@ type Driver struct {
 	Description      string
 	StorageProfile   string
 	DeleteWhenFailed bool // delete the VM from the docker-machine DB when something goes wrong
+
+	VMCount      int      // total number of VMs to compose inside the vApp
+	VMNamePrefix string   // prefix used to name the additional cluster VMs
+	VMHREFs      []string // HREFs of every VM in the vApp, in creation order; VMHREFs[0] is the docker-machine host
+
+	UserData     string // raw guest customization content (shell or cloud-init YAML), takes precedence over UserDataFile
+	UserDataFile string // path to a file holding the guest customization content
+	CloudInit    bool   // treat UserData/UserDataFile as cloud-init YAML instead of a raw customization script
+
+	Networks        []string // raw --vcd-network values, see networkSpec; falls back to VcdOrgVDCNetwork/POOL when empty
+	EdgeGateway     string   // name of the EdgeGateway to create DNAT rules on, if any
+	EdgeGatewayDNAT []string // raw --vcd-edge-dnat values: "externalIP:externalPort:internalPort[:protocol]"
+
+	// EdgeGatewayExternalIP is the EdgeGateway's external IP, set once the
+	// --vcd-edge-dnat rules are created. When set, GetIP returns it instead
+	// of the VM's internal OrgVDC address, so the host remains reachable
+	// through the EdgeGateway rather than an address only valid inside the
+	// OrgVDC.
+	EdgeGatewayExternalIP string
+
+	RunCmds       []string // commands to run over SSH once the machine is up
+	RunScriptFile string   // path to a local script whose content is run over SSH once the machine is up
+
+	DiskSizeGb int      // if set, grows the template's root disk to this size in GB
+	ExtraDisks []string // raw --vcd-extra-disk values, see extraDiskSpec
+	DiskHREFs  []string // HREFs of independent disks created for this vApp, tracked for cleanup on Remove
+
+	PlacementPolicy      string   // name of the VM placement policy to assign to every VM in the vApp
+	SizingPolicy         string   // name of the VM sizing policy to assign to every VM in the vApp
+	HostGroup            string   // name of a host-group-backed placement policy; alternative to PlacementPolicy
+	VmAffinityGroups     []string // names of VM anti-affinity rules to create, each spanning every VM in the vApp
+	VmAffinityGroupHREFs []string // HREFs of the VM anti-affinity rules created for this vApp, tracked for cleanup on Remove
 }
 
 const (
@@ -50,6 +87,13 @@ const (
 	defaultDescription      = "Created with Docker Machine"
 	defaultStorageProfile   = ""
 	defaultDeleteWhenFailed = true
+
+	defaultVMCount      = 1
+	defaultVMNamePrefix = "node"
+
+	defaultSSHUser = "root"
+
+	defaultAPIVersion = "36.3"
 )
 
 func NewDriver(hostName, storePath string) drivers.Driver {
@@ -68,12 +112,14 @@ func NewDriver(hostName, storePath string) drivers.Driver {
 		Description:      defaultDescription,
 		StorageProfile:   defaultStorageProfile,
 		DeleteWhenFailed: defaultDeleteWhenFailed,
+		VMCount:          defaultVMCount,
+		VMNamePrefix:     defaultVMNamePrefix,
 	}
 }
 
 // Create configures and creates a new vCD vm
 func (d *Driver) Create() error {
-	client, err := newClient(*d.VcdURL, d.VcdUser, d.VcdPassword, d.VcdOrg, d.VcdInsecure)
+	client, err := d.newClient()
 	if err != nil {
 		return err
 	}
@@ -86,12 +132,24 @@ func (d *Driver) Create() error {
 		return err
 	}
 
-	log.Infof("Finding OrgVdc network by name (%s)...", d.VcdOrgVDCNetwork)
-	net, err := vdc.GetOrgVdcNetworkByName(d.VcdOrgVDCNetwork, true)
+	netSpecs, err := d.networkSpecs()
 	if err != nil {
 		return err
 	}
 
+	orgVdcNetworks := map[string]*types.OrgVDCNetwork{}
+	for _, spec := range netSpecs {
+		if _, ok := orgVdcNetworks[spec.Name]; ok {
+			continue
+		}
+		log.Infof("Finding OrgVdc network by name (%s)...", spec.Name)
+		orgVdcNetwork, err := vdc.GetOrgVdcNetworkByName(spec.Name, true)
+		if err != nil {
+			return err
+		}
+		orgVdcNetworks[spec.Name] = orgVdcNetwork.OrgVDCNetwork
+	}
+
 	log.Infof("Finding catalog by name (%s)...", d.Catalog)
 	catalog, err := org.GetCatalogByName(d.Catalog, true)
 	if err != nil {
@@ -127,7 +185,9 @@ func (d *Driver) Create() error {
 
 	log.Infof("Creating a new vApp: %s...", d.MachineName)
 	networks := []*types.OrgVDCNetwork{}
-	networks = append(networks, net.OrgVDCNetwork)
+	for _, orgVdcNetwork := range orgVdcNetworks {
+		networks = append(networks, orgVdcNetwork)
+	}
 	task, err := vdc.ComposeVApp(
 		networks,
 		vapptemplate,
@@ -153,6 +213,10 @@ func (d *Driver) Create() error {
 		return fmt.Errorf("VM count != 1")
 	}
 
+	if d.VMCount < 1 {
+		d.VMCount = defaultVMCount
+	}
+
 	vm := govcd.NewVM(&client.Client)
 	vm.VM.HREF = vapp.VApp.Children.VM[0].HREF
 	err = vm.Refresh()
@@ -198,47 +262,42 @@ func (d *Driver) Create() error {
 		return fmt.Errorf("reached timeout while deploying VM")
 	}
 
-	if vm.VM.VmSpecSection == nil {
-		return fmt.Errorf("VM Spec Section empty")
-	}
-	vm.Refresh()
-
-	vm.VM.VmSpecSection.MemoryResourceMb.Configured = int64(d.MemorySizeMb)
-	vm.VM.VmSpecSection.NumCpus = &d.NumCpus
-	vm.VM.VmSpecSection.NumCoresPerSocket = &d.CoresPerSocket
-
-	log.Infof("Updating virtual hardware specs...")
-	vm, err = vm.UpdateVmSpecSection(vm.VM.VmSpecSection, d.Description)
+	vm, err = d.applyVMSizing(vm)
 	if err != nil {
 		return err
 	}
 
-	log.Infof("Configuring network...")
-	var netConn *types.NetworkConnection
-	var netSection *types.NetworkConnectionSection
-	if vm.VM.NetworkConnectionSection == nil {
-		netSection = &types.NetworkConnectionSection{}
-	} else {
-		netSection = vm.VM.NetworkConnectionSection
-	}
-
-	if len(netSection.NetworkConnection) < 1 {
-		netConn = &types.NetworkConnection{}
+	log.Infof("Configuring network (%d NIC(s))...", len(netSpecs))
+	netSection := &types.NetworkConnectionSection{}
+	primaryIndex := 0
+	for i, spec := range netSpecs {
+		netConn := &types.NetworkConnection{
+			Network:                 spec.Name,
+			NetworkConnectionIndex:  i,
+			IPAddressAllocationMode: spec.Mode,
+			IsConnected:             true,
+			NeedsCustomization:      true,
+		}
+		if spec.Mode == types.IPAllocationModeManual {
+			netConn.IPAddress = spec.IPAddress
+		}
 		netSection.NetworkConnection = append(netSection.NetworkConnection, netConn)
+		if spec.Primary {
+			primaryIndex = i
+		}
 	}
+	netSection.PrimaryNetworkConnectionIndex = primaryIndex
 
-	netConn = netSection.NetworkConnection[0]
-
-	netConn.IPAddressAllocationMode = types.IPAllocationModePool
-	netConn.NetworkConnectionIndex = 0
-	netConn.IsConnected = true
-	netConn.NeedsCustomization = true
-	netConn.Network = d.VcdOrgVDCNetwork
-
-	vm.UpdateNetworkConnectionSection(netSection)
+	if err = vm.UpdateNetworkConnectionSection(netSection); err != nil {
+		return err
+	}
 
 	log.Infof("Setting up guest customization...")
-	sshCustomScript, err := d.getGuestCustomizationScript()
+	staticIP := ""
+	if netSpecs[primaryIndex].Mode == types.IPAllocationModeManual {
+		staticIP = netSpecs[primaryIndex].IPAddress
+	}
+	sshCustomScript, err := d.getGuestCustomizationScript(staticIP)
 	if err != nil {
 		return err
 	}
@@ -251,6 +310,77 @@ func (d *Driver) Create() error {
 		return err
 	}
 
+	if len(d.ExtraDisks) > 0 {
+		log.Infof("Creating %d extra disk(s)...", len(d.ExtraDisks))
+		d.DiskHREFs, err = d.createExtraDisks(vdc, vm)
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.SizingPolicy != "" || d.PlacementPolicy != "" || d.HostGroup != "" {
+		vm, err = d.applyComputePolicies(client, vm)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.VMHREFs = []string{vm.VM.HREF}
+
+	for i := 1; i < d.VMCount; i++ {
+		memberName := fmt.Sprintf("%s-%d", d.VMNamePrefix, i)
+		log.Infof("Adding cluster member %s to vApp %s...", memberName, d.MachineName)
+		memberNetSection := &types.NetworkConnectionSection{PrimaryNetworkConnectionIndex: primaryIndex}
+		for i, spec := range netSpecs {
+			memberConn := &types.NetworkConnection{
+				Network:                 spec.Name,
+				NetworkConnectionIndex:  i,
+				IPAddressAllocationMode: spec.Mode,
+				IsConnected:             true,
+				NeedsCustomization:      true,
+			}
+			// Static IPs belong to the docker-machine host only; extra
+			// members always draw from the pool to avoid clashing addresses.
+			if spec.Mode == types.IPAllocationModeManual {
+				memberConn.IPAddressAllocationMode = types.IPAllocationModePool
+			}
+			memberNetSection.NetworkConnection = append(memberNetSection.NetworkConnection, memberConn)
+		}
+		memberTask, err := vapp.AddNewVM(memberName, vapptemplate, memberNetSection, true)
+		if err != nil {
+			return err
+		}
+		if err = memberTask.WaitTaskCompletion(); err != nil {
+			return err
+		}
+
+		member, err := vapp.GetVMByName(memberName, true)
+		if err != nil {
+			return err
+		}
+		if member, err = d.applyVMSizing(member); err != nil {
+			return err
+		}
+		member.VM.GuestCustomizationSection.Enabled = &enabled
+		member.VM.GuestCustomizationSection.CustomizationScript = sshCustomScript
+		if _, err = member.SetGuestCustomizationSection(member.VM.GuestCustomizationSection); err != nil {
+			return err
+		}
+		if d.SizingPolicy != "" || d.PlacementPolicy != "" || d.HostGroup != "" {
+			if _, err = d.applyComputePolicies(client, member); err != nil {
+				return err
+			}
+		}
+		d.VMHREFs = append(d.VMHREFs, member.VM.HREF)
+	}
+
+	if len(d.VmAffinityGroups) > 0 {
+		log.Infof("Creating %d VM affinity group(s)...", len(d.VmAffinityGroups))
+		if err = d.createVmAffinityGroups(vdc); err != nil {
+			return err
+		}
+	}
+
 	log.Infof("Booting up %s...", d.MachineName)
 	task, err = vapp.PowerOn()
 	if err != nil {
@@ -262,6 +392,42 @@ func (d *Driver) Create() error {
 
 	d.VAppHREF = vapp.VApp.HREF
 	d.VMHREF = vm.VM.HREF
+	d.VMHREFs[0] = vm.VM.HREF
+
+	if d.EdgeGateway != "" && len(d.EdgeGatewayDNAT) > 0 {
+		if err = d.createEdgeGatewayDNATRules(vdc, vm, netSpecs[primaryIndex].Name); err != nil {
+			return err
+		}
+	}
+
+	ip, err := d.GetIP()
+	if err != nil {
+		return err
+	}
+	log.Infof("Waiting for SSH to be available on %s...", ip)
+	if err = waitForTCP(net.JoinHostPort(ip, strconv.Itoa(d.SSHPort))); err != nil {
+		return err
+	}
+	if err = drivers.WaitForSSH(d); err != nil {
+		return err
+	}
+
+	commands := []string{}
+	if d.RunScriptFile != "" {
+		content, err := ioutil.ReadFile(d.RunScriptFile)
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %s", d.RunScriptFile, err)
+		}
+		commands = append(commands, string(content))
+	}
+	commands = append(commands, d.RunCmds...)
+
+	if len(commands) > 0 {
+		log.Infof("Running post-create provisioning commands...")
+		if err = d.runCommands(commands); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -303,7 +469,28 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 		mcnflag.StringFlag{
 			EnvVar: "VCD_PASSWORD",
 			Name:   "vcd-password",
-			Usage:  "vCloud Director password",
+			Usage:  "vCloud Director password; not required when a token flag is set",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_API_VERSION",
+			Name:   "vcd-api-version",
+			Usage:  "vCloud Director API version to negotiate",
+			Value:  defaultAPIVersion,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_TOKEN",
+			Name:   "vcd-token",
+			Usage:  "Generic auth token, treated as an API token; overrides username/password",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_API_TOKEN",
+			Name:   "vcd-api-token",
+			Usage:  "Long-lived API token (exchanged for a bearer token on first use); takes precedence over --vcd-bearer-token and --vcd-token",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_BEARER_TOKEN",
+			Name:   "vcd-bearer-token",
+			Usage:  "Already-a-bearer session token; takes precedence over --vcd-token, but not --vcd-api-token",
 		},
 		mcnflag.StringFlag{
 			EnvVar: "VCD_ORGVDCNETWORK",
@@ -370,21 +557,117 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Name:   "vcd-delete-when-failed",
 			Usage:  "Delete the VM from the docker-machine DB when something goes wrong",
 		},
+		mcnflag.IntFlag{
+			EnvVar: "VCD_VM_COUNT",
+			Name:   "vcd-vm-count",
+			Usage:  "Number of VMs to compose inside the vApp; only the first one is registered with docker-machine",
+			Value:  defaultVMCount,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_VM_NAME_PREFIX",
+			Name:   "vcd-vm-name-prefix",
+			Usage:  "Name prefix used for the additional VMs when vcd-vm-count is greater than 1",
+			Value:  defaultVMNamePrefix,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_SSH_USER",
+			Name:   "vcd-ssh-user",
+			Usage:  "SSH user to provision on the VM; the default customization script installs the SSH key for this user",
+			Value:  defaultSSHUser,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_USER_DATA",
+			Name:   "vcd-user-data",
+			Usage:  "Guest customization content (shell script, or cloud-init YAML with --vcd-cloud-init); overrides the built-in SSH-key-only script",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_USER_DATA_FILE",
+			Name:   "vcd-user-data-file",
+			Usage:  "Path to a file with the guest customization content; ignored if --vcd-user-data is set",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "VCD_CLOUD_INIT",
+			Name:   "vcd-cloud-init",
+			Usage:  "Treat --vcd-user-data/--vcd-user-data-file as cloud-init YAML and seed it via the NoCloud datasource",
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "VCD_NETWORK",
+			Name:   "vcd-network",
+			Usage:  "NIC to attach, as \"name[:mode[:ip[:primary]]]\" (mode is one of POOL|DHCP|MANUAL|NONE); repeatable. Defaults to a single POOL NIC on --vcd-orgvdcnetwork",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_EDGEGATEWAY",
+			Name:   "vcd-edgegateway",
+			Usage:  "Name of the EdgeGateway to create --vcd-edge-dnat rules on",
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "VCD_EDGE_DNAT",
+			Name:   "vcd-edge-dnat",
+			Usage:  "DNAT rule to create on --vcd-edgegateway, as \"externalIP:externalPort:internalPort[:protocol]\"; repeatable",
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "VCD_RUN_CMD",
+			Name:   "vcd-run-cmd",
+			Usage:  "Command to run over SSH once the machine is up; repeatable, runs in order after --vcd-run-script-file",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_RUN_SCRIPT_FILE",
+			Name:   "vcd-run-script-file",
+			Usage:  "Path to a local script whose content is run over SSH once the machine is up, before --vcd-run-cmd",
+		},
+		mcnflag.IntFlag{
+			EnvVar: "VCD_DISK_SIZE_GB",
+			Name:   "vcd-disk-size-gb",
+			Usage:  "Grow the template's root disk to this size, in GB; leave unset to keep the template's default size",
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "VCD_EXTRA_DISK",
+			Name:   "vcd-extra-disk",
+			Usage:  "Independent disk to create and attach, as \"name:sizeGB[:storageProfile[:busType]]\"; repeatable",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_PLACEMENT_POLICY",
+			Name:   "vcd-placement-policy",
+			Usage:  "Name of the VM placement policy to assign to every VM in the vApp (e.g. to land on GPU-backed hosts); mutually exclusive with --vcd-host-group",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_SIZING_POLICY",
+			Name:   "vcd-sizing-policy",
+			Usage:  "Name of the VM sizing policy to assign to every VM in the vApp",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "VCD_HOST_GROUP",
+			Name:   "vcd-host-group",
+			Usage:  "Name of a host-group-backed placement policy to assign to every VM in the vApp; mutually exclusive with --vcd-placement-policy",
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "VCD_VM_AFFINITY_GROUP",
+			Name:   "vcd-vm-affinity-group",
+			Usage:  "Name of a mandatory VM anti-affinity rule to create spanning every VM in the vApp, so cluster nodes land on different hosts; repeatable, requires --vcd-vm-count >= 2",
+		},
 	}
 }
 
 // GetIP returns an IP or hostname that this host is available at
 // e.g. 1.2.3.4 or docker-host-d60b70a14d3a.cloudapp.net
 func (d *Driver) GetIP() (string, error) {
+	if d.EdgeGatewayExternalIP != "" {
+		return d.EdgeGatewayExternalIP, nil
+	}
+
 	vm, err := d.getVM()
 	if err != nil {
 		return "", err
 	}
 
-	// We assume that the vApp has only one VM with only one NIC
+	// With multiple NICs (see --vcd-network) we only expose the primary one
+	// to docker-machine; the others are reachable through ListVMs/GetVM.
 	if vm.VM.NetworkConnectionSection != nil {
-		networks := vm.VM.NetworkConnectionSection.NetworkConnection
-		for _, n := range networks {
+		primaryIndex := vm.VM.NetworkConnectionSection.PrimaryNetworkConnectionIndex
+		for _, n := range vm.VM.NetworkConnectionSection.NetworkConnection {
+			if n.NetworkConnectionIndex != primaryIndex {
+				continue
+			}
 			if n.ExternalIPAddress != "" {
 				return n.ExternalIPAddress, nil
 			}
@@ -415,6 +698,49 @@ func (d *Driver) GetURL() (string, error) {
 	return fmt.Sprintf("tcp://%s", net.JoinHostPort(ip, strconv.Itoa(d.DockerPort))), nil
 }
 
+// ListVMs returns every VM composed inside the vApp, in creation order.
+// The first entry is always the docker-machine host itself; the rest are
+// only addressable through this API, e.g. to bootstrap Swarm/Rancher
+// worker nodes that share the vApp with the host.
+func (d *Driver) ListVMs() ([]*govcd.VM, error) {
+	if len(d.VMHREFs) == 0 {
+		vm, err := d.getVM()
+		if err != nil {
+			return nil, err
+		}
+		return []*govcd.VM{vm}, nil
+	}
+
+	client, err := d.newClient()
+	if err != nil {
+		return nil, err
+	}
+
+	vms := make([]*govcd.VM, 0, len(d.VMHREFs))
+	for _, href := range d.VMHREFs {
+		vm := govcd.NewVM(&client.Client)
+		vm.VM.HREF = href
+		if err = vm.Refresh(); err != nil {
+			return nil, err
+		}
+		vms = append(vms, vm)
+	}
+	return vms, nil
+}
+
+// GetVM returns the VM at the given index inside the vApp, where index 0 is
+// the docker-machine host. It fails if the index is out of range.
+func (d *Driver) GetVM(index int) (*govcd.VM, error) {
+	vms, err := d.ListVMs()
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 || index >= len(vms) {
+		return nil, fmt.Errorf("VM index %d out of range (vApp has %d VMs)", index, len(vms))
+	}
+	return vms[index], nil
+}
+
 // GetState returns the state that the host is in (running, stopped, etc)
 func (d *Driver) GetState() (state.State, error) {
 	vapp, err := d.getVApp()
@@ -501,6 +827,25 @@ func (d *Driver) Remove() error {
 		}
 	}
 
+	if len(d.DiskHREFs) > 0 || len(d.VmAffinityGroupHREFs) > 0 {
+		vdc, err := d.getVdc()
+		if err != nil {
+			log.Warnf("Could not get the VDC to delete the independent disks and VM affinity rules: %s", err)
+		} else {
+			if len(d.DiskHREFs) > 0 {
+				vm, err := d.getVM()
+				if err != nil {
+					log.Warnf("Could not get the VM to detach its independent disks: %s", err)
+					vm = nil
+				}
+				d.detachAndDeleteDisks(vdc, vm)
+			}
+			if len(d.VmAffinityGroupHREFs) > 0 {
+				d.deleteVmAffinityGroups(vdc)
+			}
+		}
+	}
+
 	task, err = vapp.Delete()
 	if err != nil {
 		return err
@@ -540,15 +885,31 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.VcdInsecure = flags.Bool("vcd-insecure")
 	d.VcdUser = flags.String("vcd-user")
 	d.VcdPassword = flags.String("vcd-password")
+	d.VcdAPIVersion = flags.String("vcd-api-version")
+	d.VcdToken = flags.String("vcd-token")
+	d.VcdAPIToken = flags.String("vcd-api-token")
+	d.VcdBearerToken = flags.String("vcd-bearer-token")
 	d.VcdOrgVDCNetwork = flags.String("vcd-orgvdcnetwork")
 	d.Catalog = flags.String("vcd-catalog")
 	d.Template = flags.String("vcd-template")
 
 	d.SetSwarmConfigFromFlags(flags)
 
-	// Check for required Params
-	if vcdURL == "" || d.VcdOrg == "" || d.VcdVdc == "" || d.VcdUser == "" || d.VcdPassword == "" || d.VcdOrgVDCNetwork == "" || d.Catalog == "" || d.Template == "" {
-		return fmt.Errorf("please specify the mandatory parameters: -vcd-url, -vcd-org, -vcd-vdc, -vcd-user, -vcd-password, -vcd-orgvdcnetwork, -catalog, -template")
+	d.Networks = flags.StringSlice("vcd-network")
+
+	usingToken := d.VcdToken != "" || d.VcdAPIToken != "" || d.VcdBearerToken != ""
+
+	// Check for required Params. --vcd-network can be used instead of the
+	// legacy --vcd-orgvdcnetwork to configure the NIC(s); a token flag can be
+	// used instead of --vcd-user/--vcd-password.
+	if vcdURL == "" || d.VcdOrg == "" || d.VcdVdc == "" || d.Catalog == "" || d.Template == "" {
+		return fmt.Errorf("please specify the mandatory parameters: -vcd-url, -vcd-org, -vcd-vdc, -catalog, -template")
+	}
+	if !usingToken && (d.VcdUser == "" || d.VcdPassword == "") {
+		return fmt.Errorf("please specify -vcd-user and -vcd-password, or one of -vcd-token/-vcd-api-token/-vcd-bearer-token")
+	}
+	if d.VcdOrgVDCNetwork == "" && len(d.Networks) == 0 {
+		return fmt.Errorf("please specify at least one network via -vcd-orgvdcnetwork or -vcd-network")
 	}
 
 	u, err := url.ParseRequestURI(vcdURL)
@@ -558,7 +919,7 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.VcdURL = u
 
 	d.DockerPort = flags.Int("vcd-docker-port")
-	d.SSHUser = "root"
+	d.SSHUser = flags.String("vcd-ssh-user")
 	d.SSHPort = flags.Int("vcd-ssh-port")
 	d.NumCpus = flags.Int("vcd-numcpus")
 	d.CoresPerSocket = flags.Int("vcd-corespersocket")
@@ -566,6 +927,27 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.StorageProfile = flags.String("vcd-storageprofile")
 	d.Description = flags.String("vcd-description")
 	d.DeleteWhenFailed = flags.Bool("vcd-delete-when-failed")
+	d.VMCount = flags.Int("vcd-vm-count")
+	if d.VMCount < 1 {
+		d.VMCount = defaultVMCount
+	}
+	d.VMNamePrefix = flags.String("vcd-vm-name-prefix")
+	d.UserData = flags.String("vcd-user-data")
+	d.UserDataFile = flags.String("vcd-user-data-file")
+	d.CloudInit = flags.Bool("vcd-cloud-init")
+	d.EdgeGateway = flags.String("vcd-edgegateway")
+	d.EdgeGatewayDNAT = flags.StringSlice("vcd-edge-dnat")
+	if d.EdgeGateway == "" && len(d.EdgeGatewayDNAT) > 0 {
+		return fmt.Errorf("please specify -vcd-edgegateway to create the -vcd-edge-dnat rule(s) on")
+	}
+	d.RunCmds = flags.StringSlice("vcd-run-cmd")
+	d.RunScriptFile = flags.String("vcd-run-script-file")
+	d.DiskSizeGb = flags.Int("vcd-disk-size-gb")
+	d.ExtraDisks = flags.StringSlice("vcd-extra-disk")
+	d.PlacementPolicy = flags.String("vcd-placement-policy")
+	d.SizingPolicy = flags.String("vcd-sizing-policy")
+	d.HostGroup = flags.String("vcd-host-group")
+	d.VmAffinityGroups = flags.StringSlice("vcd-vm-affinity-group")
 
 	return nil
 }
@@ -606,21 +988,17 @@ func (d *Driver) Stop() error {
 	return nil
 }
 
+// runCommands executes each command over SSH, in order, stopping at the
+// first failure. Used to run --vcd-run-cmd/--vcd-run-script-file after the
+// machine has booted.
 func (d *Driver) runCommands(commands []string) error {
-	// provisioner := provision.GenericProvisioner{
-	// 	Driver: d,
-	// }
-
-	// fmt.Println(provisioner.GetOsReleaseInfo())
-
 	for _, c := range commands {
-		fmt.Printf("Running: '%s'\n", c)
-		// _, err := provisioner.SSHCommand(c)
-		_, err := drivers.RunSSHCommandFromDriver(d, c)
+		log.Infof("Running: '%s'", c)
+		output, err := drivers.RunSSHCommandFromDriver(d, c)
 		if err != nil {
-			fmt.Println(err)
 			return err
 		}
+		log.Debugf("Command output: %s", output)
 	}
 	return nil
 }